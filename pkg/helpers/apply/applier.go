@@ -0,0 +1,324 @@
+// Copyright Contributors to the Open Cluster Management project
+package apply
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+
+	"open-cluster-management.io/clusteradm/pkg/helpers/asset"
+)
+
+const (
+	crdEstablishedTimeout  = 60 * time.Second
+	namespaceActiveTimeout = 60 * time.Second
+)
+
+var crdGVR = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+var namespaceGVR = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
+//installOrder lists, in install order, the GroupKinds that other resources
+//commonly depend on. GroupKinds that are not listed here are installed last, in
+//alphabetical order of Kind. Uninstall walks the same order in reverse.
+var installOrder = []schema.GroupKind{
+	{Kind: "Namespace"},
+	{Group: "networking.k8s.io", Kind: "NetworkPolicy"},
+	{Kind: "ResourceQuota"},
+	{Kind: "LimitRange"},
+	{Group: "policy", Kind: "PodSecurityPolicy"},
+	{Kind: "ServiceAccount"},
+	{Kind: "Secret"},
+	{Kind: "ConfigMap"},
+	{Group: "storage.k8s.io", Kind: "StorageClass"},
+	{Kind: "PersistentVolume"},
+	{Kind: "PersistentVolumeClaim"},
+	{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"},
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole"},
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRoleBinding"},
+	{Group: "rbac.authorization.k8s.io", Kind: "Role"},
+	{Group: "rbac.authorization.k8s.io", Kind: "RoleBinding"},
+	{Kind: "Service"},
+	{Group: "apps", Kind: "DaemonSet"},
+	{Group: "apps", Kind: "StatefulSet"},
+	{Group: "apps", Kind: "Deployment"},
+	{Group: "batch", Kind: "Job"},
+	{Group: "batch", Kind: "CronJob"},
+	{Group: "networking.k8s.io", Kind: "Ingress"},
+	{Group: "apiregistration.k8s.io", Kind: "APIService"},
+	{Group: "admissionregistration.k8s.io", Kind: "MutatingWebhookConfiguration"},
+	{Group: "admissionregistration.k8s.io", Kind: "ValidatingWebhookConfiguration"},
+}
+
+var installOrderIndex = func() map[schema.GroupKind]int {
+	idx := make(map[schema.GroupKind]int, len(installOrder))
+	for i, gk := range installOrder {
+		idx[gk] = i
+	}
+	return idx
+}()
+
+//Applier renders a set of templated files, decodes every one of them into an
+//unstructured object, and applies them grouped by GroupKind in the dependency
+//order described by installOrder. It blocks between phases so that a later
+//phase can rely on an earlier one being ready, for example creating custom
+//resources only once their CustomResourceDefinition is Established.
+type Applier struct {
+	dynamicClient   dynamic.Interface
+	discoveryClient discovery.DiscoveryInterface
+	mapper          meta.RESTMapper
+	reader          asset.ScenarioReader
+	values          interface{}
+	headerFile      string
+	opts            Options
+}
+
+//NewApplier returns an Applier that renders reader's assets with values and
+//applies them through dynamicClient.
+func NewApplier(dynamicClient dynamic.Interface,
+	discoveryClient discovery.DiscoveryInterface,
+	reader asset.ScenarioReader,
+	values interface{},
+	headerFile string) *Applier {
+	return &Applier{
+		dynamicClient:   dynamicClient,
+		discoveryClient: discoveryClient,
+		mapper:          restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+		reader:          reader,
+		values:          values,
+		headerFile:      headerFile,
+	}
+}
+
+//WithEnhancers registers enhancers to run over every object this Applier
+//applies, in order, and returns the Applier for chaining.
+func (a *Applier) WithEnhancers(enhancers ...Enhancer) *Applier {
+	a.opts.Enhancers = append(a.opts.Enhancers, enhancers...)
+	return a
+}
+
+//WithServerSideApply switches this Applier to ModeServerSideApply, with the
+//given FieldManager (falling back to DefaultFieldManager when empty) and
+//Force setting, and returns the Applier for chaining.
+func (a *Applier) WithServerSideApply(fieldManager string, force bool) *Applier {
+	a.opts.Mode = ModeServerSideApply
+	a.opts.FieldManager = fieldManager
+	a.opts.Force = force
+	return a
+}
+
+//Apply renders files, groups the resulting objects by GroupKind and applies
+//them phase by phase in installOrder, waiting for CustomResourceDefinitions to
+//become Established and Namespaces to become Active before moving to the next
+//phase.
+func (a *Applier) Apply(files ...string) error {
+	objs, err := a.render(files)
+	if err != nil {
+		return err
+	}
+	sortByInstallOrder(objs)
+	for _, phase := range groupByKind(objs) {
+		for _, u := range phase.objects {
+			if err := enhance(u, a.opts.Enhancers); err != nil {
+				return fmt.Errorf("%s %s/%s: %v", u.GetKind(), u.GetNamespace(), u.GetName(), err)
+			}
+			if err := applyUnstructured(a.dynamicClient, a.mapper, u, a.opts); err != nil {
+				return fmt.Errorf("%s %s/%s: %v", u.GetKind(), u.GetNamespace(), u.GetName(), err)
+			}
+		}
+		if err := a.waitReady(phase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Uninstall removes the objects rendered from files, in the reverse of the
+//install order, skipping any GroupVersionKind that is no longer registered on
+//the cluster (for example a custom resource whose CRD was already deleted).
+func (a *Applier) Uninstall(files ...string) error {
+	objs, err := a.render(files)
+	if err != nil {
+		return err
+	}
+	registered, err := registeredGroupKinds(a.discoveryClient)
+	if err != nil {
+		return err
+	}
+	sortByInstallOrder(objs)
+	phases := groupByKind(objs)
+	for i := len(phases) - 1; i >= 0; i-- {
+		if _, ok := registered[phases[i].kind]; !ok {
+			continue
+		}
+		for _, u := range phases[i].objects {
+			if err := deleteUnstructured(a.dynamicClient, a.mapper, u); err != nil {
+				return fmt.Errorf("%s %s/%s: %v", u.GetKind(), u.GetNamespace(), u.GetName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Applier) render(files []string) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	for _, name := range files {
+		fileObjs, err := renderObjects(a.reader, a.values, a.headerFile, name)
+		if err != nil {
+			if IsEmptyAsset(err) {
+				continue
+			}
+			return nil, err
+		}
+		objs = append(objs, fileObjs...)
+	}
+	return objs, nil
+}
+
+func (a *Applier) waitReady(phase kindGroup) error {
+	switch phase.kind.Kind {
+	case "CustomResourceDefinition":
+		return a.waitForCRDsEstablished(phase.objects)
+	case "Namespace":
+		return a.waitForNamespacesActive(phase.objects)
+	}
+	return nil
+}
+
+func (a *Applier) waitForCRDsEstablished(crds []*unstructured.Unstructured) error {
+	for _, crd := range crds {
+		name := crd.GetName()
+		err := wait.PollImmediate(time.Second, crdEstablishedTimeout, func() (bool, error) {
+			obj, err := a.dynamicClient.Resource(crdGVR).Get(context.TODO(), name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return isConditionTrue(obj, "Established"), nil
+		})
+		if err != nil {
+			return fmt.Errorf("waiting for CustomResourceDefinition %q to be Established: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (a *Applier) waitForNamespacesActive(namespaces []*unstructured.Unstructured) error {
+	for _, ns := range namespaces {
+		name := ns.GetName()
+		err := wait.PollImmediate(time.Second, namespaceActiveTimeout, func() (bool, error) {
+			obj, err := a.dynamicClient.Resource(namespaceGVR).Get(context.TODO(), name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+			return phase == "Active", nil
+		})
+		if err != nil {
+			return fmt.Errorf("waiting for Namespace %q to be Active: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func isConditionTrue(u *unstructured.Unstructured, conditionType string) bool {
+	conditions, found, err := unstructured.NestedSlice(u.Object, "status", "conditions")
+	if err != nil || !found {
+		return false
+	}
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if condition["type"] == conditionType && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+//kindGroup is a set of objects sharing the same GroupKind, applied together as
+//one phase of the Applier.
+type kindGroup struct {
+	kind    schema.GroupKind
+	objects []*unstructured.Unstructured
+}
+
+//groupByKind groups already install-ordered objects into consecutive phases by
+//GroupKind.
+func groupByKind(objs []*unstructured.Unstructured) []kindGroup {
+	var groups []kindGroup
+	for _, u := range objs {
+		gk := u.GroupVersionKind().GroupKind()
+		if len(groups) > 0 && groups[len(groups)-1].kind == gk {
+			groups[len(groups)-1].objects = append(groups[len(groups)-1].objects, u)
+			continue
+		}
+		groups = append(groups, kindGroup{kind: gk, objects: []*unstructured.Unstructured{u}})
+	}
+	return groups
+}
+
+//installRank returns gk's position in installOrder, or len(installOrder) for
+//any GroupKind not listed there.
+func installRank(gk schema.GroupKind) int {
+	if i, ok := installOrderIndex[gk]; ok {
+		return i
+	}
+	return len(installOrder)
+}
+
+//sortByInstallOrder sorts objs in place following installOrder; GroupKinds not
+//listed there sort after every listed one, alphabetically by Kind.
+func sortByInstallOrder(objs []*unstructured.Unstructured) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		gki, gkj := objs[i].GroupVersionKind().GroupKind(), objs[j].GroupVersionKind().GroupKind()
+		ri, rj := installRank(gki), installRank(gkj)
+		if ri != rj {
+			return ri < rj
+		}
+		if ri == len(installOrder) {
+			return gki.Kind < gkj.Kind
+		}
+		return false
+	})
+}
+
+//sortGroupKindsByInstallOrder sorts gks in place following installOrder;
+//GroupKinds not listed there sort after every listed one, alphabetically by
+//Kind.
+func sortGroupKindsByInstallOrder(gks []schema.GroupKind) {
+	sort.SliceStable(gks, func(i, j int) bool {
+		ri, rj := installRank(gks[i]), installRank(gks[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return gks[i].Kind < gks[j].Kind
+	})
+}
+
+//deleteUnstructured deletes u, treating it already being gone as success.
+func deleteUnstructured(client dynamic.Interface, mapper meta.RESTMapper, u *unstructured.Unstructured) error {
+	gvk := u.GroupVersionKind()
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return err
+	}
+	err = client.Resource(mapping.Resource).Namespace(u.GetNamespace()).
+		Delete(context.TODO(), u.GetName(), metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
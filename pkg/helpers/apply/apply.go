@@ -5,13 +5,16 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"regexp"
 	"strings"
 	"text/template"
 
 	"github.com/Masterminds/sprig"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"open-cluster-management.io/clusteradm/pkg/helpers"
 	"open-cluster-management.io/clusteradm/pkg/helpers/asset"
 
@@ -19,6 +22,8 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/dynamic"
@@ -40,16 +45,31 @@ var (
 	genericCodec  = genericCodecs.UniversalDeserializer()
 )
 
-//ApplyDeployment applies a appsv1.Deployment template
+//ApplyDeployment applies a appsv1.Deployment template with no enhancers. See
+//ApplyDeploymentWithOptions.
 func ApplyDeployment(
 	client kubernetes.Interface,
 	reader asset.ScenarioReader,
 	values interface{},
 	headerFile string,
 	files ...string) error {
+	return ApplyDeploymentWithOptions(client, reader, values, headerFile, nil, files...)
+}
+
+//ApplyDeploymentWithOptions applies a appsv1.Deployment template, running it
+//through enhancers before applying it. A file can hold several YAML documents
+//separated by "---"; each one is applied independently and a single document
+//failing does not stop the others from being applied.
+func ApplyDeploymentWithOptions(
+	client kubernetes.Interface,
+	reader asset.ScenarioReader,
+	values interface{},
+	headerFile string,
+	enhancers []Enhancer,
+	files ...string) error {
 	genericScheme.AddKnownTypes(appsv1.SchemeGroupVersion, &appsv1.Deployment{})
 	recorder := events.NewInMemoryRecorder(helpers.GetExampleHeader())
-	//Render each file
+	var errs []error
 	for _, name := range files {
 		deploymentBytes, err := MustTempalteAsset(name, headerFile, reader, values)
 		if err != nil {
@@ -58,87 +78,244 @@ func ApplyDeployment(
 			}
 			return err
 		}
-		deployment, sch, err := genericCodec.Decode(deploymentBytes, nil, nil)
+		docs, err := splitYAMLDocuments(deploymentBytes)
 		if err != nil {
-			return fmt.Errorf("%q: %v %v", name, sch, err)
+			return fmt.Errorf("%q: %v", name, err)
 		}
-		_, _, err = resourceapply.ApplyDeployment(
-			client.AppsV1(),
-			recorder,
-			deployment.(*appsv1.Deployment), 0)
-		if err != nil {
-			return fmt.Errorf("%q (%T): %v", name, deployment, err)
+		for i, doc := range docs {
+			object, sch, err := genericCodec.Decode(doc, nil, nil)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %v %v", name, i, sch, err))
+				continue
+			}
+			deployment := object.(*appsv1.Deployment)
+			if err := enhanceTyped(deployment, enhancers); err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %v", name, i, err))
+				continue
+			}
+			_, _, err = resourceapply.ApplyDeployment(
+				client.AppsV1(),
+				recorder,
+				deployment, 0)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d] (%T): %v", name, i, deployment, err))
+			}
 		}
 	}
-	return nil
+	return utilerrors.NewAggregate(errs)
 }
 
-//ApplyDirectly applies standard kubernetes resources.
+//ApplyDirectly applies standard kubernetes resources with no enhancers. See
+//ApplyDirectlyWithOptions.
 func ApplyDirectly(clients *resourceapply.ClientHolder,
 	reader asset.ScenarioReader,
 	values interface{},
 	headerFile string,
 	files ...string) error {
+	return ApplyDirectlyWithOptions(clients, reader, values, headerFile, nil, files...)
+}
+
+//ApplyDirectlyWithOptions applies standard kubernetes resources, running each
+//one through enhancers before applying it. A file can hold several YAML
+//documents separated by "---"; each one is applied independently and a single
+//document failing does not stop the others from being applied.
+func ApplyDirectlyWithOptions(clients *resourceapply.ClientHolder,
+	reader asset.ScenarioReader,
+	values interface{},
+	headerFile string,
+	enhancers []Enhancer,
+	files ...string) error {
 	recorder := events.NewInMemoryRecorder(helpers.GetExampleHeader())
-	//Apply resources
-	resourceResults := resourceapply.ApplyDirectly(clients, recorder, func(name string) ([]byte, error) {
-		return MustTempalteAsset(name, headerFile, reader, values)
-	}, files...)
-	//Check errors
-	for _, result := range resourceResults {
-		if result.Error != nil && !IsEmptyAsset(result.Error) {
-			return fmt.Errorf("%q (%T): %v", result.File, result.Type, result.Error)
+	var errs []error
+	for _, name := range files {
+		b, err := MustTempalteAsset(name, headerFile, reader, values)
+		if err != nil {
+			if IsEmptyAsset(err) {
+				continue
+			}
+			return err
+		}
+		docs, err := splitYAMLDocuments(b)
+		if err != nil {
+			return fmt.Errorf("%q: %v", name, err)
+		}
+		for i, d := range docs {
+			u, err := bytesToUnstructured(reader, d)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %v", name, i, err))
+				continue
+			}
+			if err := enhance(u, enhancers); err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %v", name, i, err))
+				continue
+			}
+			doc, err := u.MarshalJSON()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %v", name, i, err))
+				continue
+			}
+			docName := fmt.Sprintf("%s[%d]", name, i)
+			resourceResults := resourceapply.ApplyDirectly(clients, recorder, func(_ string) ([]byte, error) {
+				return doc, nil
+			}, docName)
+			for _, result := range resourceResults {
+				if result.Error != nil && !IsEmptyAsset(result.Error) {
+					errs = append(errs, fmt.Errorf("%s (%T): %v", docName, result.Type, result.Error))
+				}
+			}
 		}
 	}
-	return nil
+	return utilerrors.NewAggregate(errs)
 }
 
-//ApplyCustomResouces applies custom resources
+//ApplyCustomResouces applies custom resources with ModeClientSide and no
+//enhancers. See ApplyCustomResoucesWithOptions.
 func ApplyCustomResouces(client dynamic.Interface,
 	discoveryClient discovery.DiscoveryInterface,
 	reader asset.ScenarioReader,
 	values interface{},
 	headerFile string,
 	files ...string) error {
+	return ApplyCustomResoucesWithOptions(client, discoveryClient, reader, values, headerFile, Options{}, files...)
+}
+
+//ApplyCustomResoucesWithOptions applies custom resources, running each one
+//through opts.Enhancers before applying it with the strategy selected by
+//opts.Mode. A file can hold several YAML documents separated by "---"; each
+//one is applied independently and a single document failing does not stop the
+//others from being applied.
+func ApplyCustomResoucesWithOptions(client dynamic.Interface,
+	discoveryClient discovery.DiscoveryInterface,
+	reader asset.ScenarioReader,
+	values interface{},
+	headerFile string,
+	opts Options,
+	files ...string) error {
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+	var errs []error
 	for _, name := range files {
-		asset, err := MustTempalteAsset(name, headerFile, reader, values)
+		b, err := MustTempalteAsset(name, headerFile, reader, values)
 		if err != nil {
 			if IsEmptyAsset(err) {
 				continue
 			}
 			return err
 		}
-		u, err := bytesToUnstructured(reader, asset)
+		docs, err := splitYAMLDocuments(b)
 		if err != nil {
-			return err
+			return fmt.Errorf("%q: %v", name, err)
 		}
-		gvks, _, err := genericScheme.ObjectKinds(u)
+		for i, d := range docs {
+			u, err := bytesToUnstructured(reader, d)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %v", name, i, err))
+				continue
+			}
+			if err := enhance(u, opts.Enhancers); err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %v", name, i, err))
+				continue
+			}
+			if err := applyUnstructured(client, mapper, u, opts); err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d] (%T): %v", name, i, u, err))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+//applyUnstructured reconciles u with the cluster using the strategy selected by
+//opts.Mode. In ModeClientSide it creates u if it does not exist yet, or
+//updates it in place otherwise. In ModeServerSideApply it issues a
+//server-side apply PATCH, which the API server uses to merge field ownership
+//instead of a client-side read-modify-write. It is the single-object
+//primitive shared by ApplyCustomResouces and the ordered Applier.
+func applyUnstructured(client dynamic.Interface, mapper meta.RESTMapper, u *unstructured.Unstructured, opts Options) error {
+	gvk := u.GroupVersionKind()
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return err
+	}
+	dr := client.Resource(mapping.Resource).Namespace(u.GetNamespace())
+
+	if opts.Mode == ModeServerSideApply {
+		data, err := applyPatchBody(u)
 		if err != nil {
 			return err
 		}
-		gvk := gvks[0]
-		mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
-		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
-		if err != nil {
+		force := opts.Force
+		_, err = dr.Patch(context.TODO(), u.GetName(), types.ApplyPatchType, data,
+			metav1.PatchOptions{FieldManager: opts.fieldManager(), Force: &force})
+		return err
+	}
+
+	existing, err := dr.Get(context.TODO(), u.GetName(), metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
 			return err
 		}
-		dr := client.Resource(mapping.Resource)
-		ug, err := dr.Namespace(u.GetNamespace()).Get(context.TODO(), u.GetName(), metav1.GetOptions{})
+		_, err = dr.Create(context.TODO(), u, metav1.CreateOptions{})
+		return err
+	}
+	u.SetResourceVersion(existing.GetResourceVersion())
+	_, err = dr.Update(context.TODO(), u, metav1.UpdateOptions{})
+	return err
+}
+
+//applyPatchBody renders u as the JSON body for a server-side apply PATCH. The
+//server rejects a patch body carrying metadata.managedFields, and a stale
+//metadata.resourceVersion only gets in the way of field-manager merging, so
+//both are stripped from a copy before marshaling; u itself is left untouched.
+func applyPatchBody(u *unstructured.Unstructured) ([]byte, error) {
+	u = u.DeepCopy()
+	unstructured.RemoveNestedField(u.Object, "metadata", "managedFields")
+	unstructured.RemoveNestedField(u.Object, "metadata", "resourceVersion")
+	return u.MarshalJSON()
+}
+
+//renderObjects renders name and decodes each YAML document it contains into an
+//unstructured object, skipping empty documents. It returns an
+//ErrorEmptyAssetAfterTemplating error, recognized by IsEmptyAsset, when the
+//whole file renders to nothing.
+func renderObjects(reader asset.ScenarioReader, values interface{}, headerFile, name string) ([]*unstructured.Unstructured, error) {
+	b, err := MustTempalteAsset(name, headerFile, reader, values)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := splitYAMLDocuments(b)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", name, err)
+	}
+	objs := make([]*unstructured.Unstructured, 0, len(docs))
+	for i, doc := range docs {
+		u, err := bytesToUnstructured(reader, doc)
 		if err != nil {
-			if errors.IsNotFound(err) {
-				_, err = dr.Namespace(u.GetNamespace()).
-					Create(context.TODO(), u, metav1.CreateOptions{})
+			return nil, fmt.Errorf("%s[%d]: %v", name, i, err)
+		}
+		objs = append(objs, u)
+	}
+	return objs, nil
+}
+
+//splitYAMLDocuments splits a rendered asset into its individual YAML (or JSON)
+//documents, skipping any that are empty once comments and blank lines are
+//stripped.
+func splitYAMLDocuments(data []byte) ([][]byte, error) {
+	var docs [][]byte
+	decoder := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader(data), len(data))
+	for {
+		var raw runtime.RawExtension
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				break
 			}
-		} else {
-			u.SetResourceVersion(ug.GetResourceVersion())
-			_, err = dr.Namespace(u.GetNamespace()).
-				Update(context.TODO(), u, metav1.UpdateOptions{})
+			return nil, err
 		}
-		if err != nil {
-			return err
+		if isEmpty(raw.Raw) {
+			continue
 		}
+		docs = append(docs, raw.Raw)
 	}
-	return nil
+	return docs, nil
 }
 
 //bytesToUnstructured converts an asset to unstructured.
@@ -0,0 +1,94 @@
+// Copyright Contributors to the Open Cluster Management project
+package apply
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+//fakeRESTMapper builds a RESTMapper that only knows about ConfigMaps, the kind
+//applyUnstructured is exercised against below.
+func fakeRESTMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{{Version: "v1"}})
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	return mapper
+}
+
+func newConfigMap(name string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetName(name)
+	u.SetNamespace("default")
+	return u
+}
+
+//TestApplyUnstructured_ServerSideApply_StripsManagedFields verifies that the
+//PATCH body applyUnstructured sends under ModeServerSideApply is the rendered
+//object stripped of metadata.managedFields and metadata.resourceVersion, and
+//that it is issued as a types.ApplyPatchType patch.
+func TestApplyUnstructured_ServerSideApply_StripsManagedFields(t *testing.T) {
+	u := newConfigMap("my-config")
+	u.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "some-other-manager"}})
+	u.SetResourceVersion("12345")
+
+	gvrToListKind := map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "configmaps"}: "ConfigMapList",
+	}
+	scheme := runtime.NewScheme()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(scheme, gvrToListKind)
+
+	mapper := fakeRESTMapper()
+
+	opts := Options{Mode: ModeServerSideApply, FieldManager: "test-manager", Force: true}
+	err := applyUnstructured(client, mapper, u, opts)
+
+	var patchAction kubetesting.PatchAction
+	for _, action := range client.Actions() {
+		if pa, ok := action.(kubetesting.PatchAction); ok {
+			patchAction = pa
+			break
+		}
+	}
+	if patchAction == nil {
+		t.Fatalf("no patch action recorded (applyUnstructured err: %v), got actions: %v", err, client.Actions())
+	}
+	//The fake records the action, body and patch type before attempting to
+	//apply it, so the assertions below hold even on client-go versions whose
+	//fake ObjectTracker doesn't implement types.ApplyPatchType; only fail here
+	//on an error that isn't that known fake limitation.
+	if err != nil && !strings.Contains(err.Error(), "PatchType is not supported") {
+		t.Fatalf("applyUnstructured: %v", err)
+	}
+	if patchAction.GetPatchType() != types.ApplyPatchType {
+		t.Fatalf("expected patch type %q, got %q", types.ApplyPatchType, patchAction.GetPatchType())
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(patchAction.GetPatch(), &body); err != nil {
+		t.Fatalf("unmarshaling patch body: %v", err)
+	}
+	metadata, _ := body["metadata"].(map[string]interface{})
+	if metadata == nil {
+		t.Fatalf("patch body has no metadata: %s", patchAction.GetPatch())
+	}
+	if _, ok := metadata["managedFields"]; ok {
+		t.Errorf("patch body still carries metadata.managedFields: %s", patchAction.GetPatch())
+	}
+	if _, ok := metadata["resourceVersion"]; ok {
+		t.Errorf("patch body still carries metadata.resourceVersion: %s", patchAction.GetPatch())
+	}
+	if metadata["name"] != "my-config" {
+		t.Errorf("patch body lost metadata.name: %s", patchAction.GetPatch())
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright Contributors to the Open Cluster Management project
+package apply
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/klog"
+
+	"open-cluster-management.io/clusteradm/pkg/helpers/asset"
+)
+
+//DeleteDirectly removes the standard kubernetes resources rendered from files,
+//skipping any GroupVersionKind that is no longer registered on the cluster so
+//that uninstalling after a CustomResourceDefinition has already been removed
+//does not error out.
+func DeleteDirectly(dynamicClient dynamic.Interface,
+	discoveryClient discovery.DiscoveryInterface,
+	reader asset.ScenarioReader,
+	values interface{},
+	headerFile string,
+	files ...string) error {
+	return deleteRendered(dynamicClient, discoveryClient, reader, values, headerFile, files)
+}
+
+//DeleteCustomResources removes the custom resources rendered from files,
+//skipping any GroupVersionKind that is no longer registered on the cluster
+//(for example because its CustomResourceDefinition has already been deleted).
+//Deletion through the dynamic client does not distinguish between built-in and
+//custom resources, so this behaves exactly like DeleteDirectly; it exists
+//under its own name to mirror ApplyCustomResouces/ApplyDirectly for callers
+//that want that distinction in their own code.
+func DeleteCustomResources(dynamicClient dynamic.Interface,
+	discoveryClient discovery.DiscoveryInterface,
+	reader asset.ScenarioReader,
+	values interface{},
+	headerFile string,
+	files ...string) error {
+	return DeleteDirectly(dynamicClient, discoveryClient, reader, values, headerFile, files...)
+}
+
+//deleteRendered deletes the objects rendered from files in the reverse of the
+//install order described by installOrder, mirroring how Applier.Uninstall
+//reverses its own install order.
+func deleteRendered(dynamicClient dynamic.Interface,
+	discoveryClient discovery.DiscoveryInterface,
+	reader asset.ScenarioReader,
+	values interface{},
+	headerFile string,
+	files []string) error {
+	registered, err := registeredGroupKinds(discoveryClient)
+	if err != nil {
+		return err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+
+	var objs []*unstructured.Unstructured
+	for _, name := range files {
+		fileObjs, err := renderObjects(reader, values, headerFile, name)
+		if err != nil {
+			if IsEmptyAsset(err) {
+				continue
+			}
+			return err
+		}
+		objs = append(objs, fileObjs...)
+	}
+	sortByInstallOrder(objs)
+
+	var errs []error
+	for i := len(objs) - 1; i >= 0; i-- {
+		u := objs[i]
+		if _, ok := registered[u.GroupVersionKind().GroupKind()]; !ok {
+			klog.V(2).Infof("skipping %s %s: %s is no longer registered on the cluster", u.GetKind(), namespacedName(u), u.GroupVersionKind())
+			continue
+		}
+		if err := deleteUnstructured(dynamicClient, mapper, u); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %v", u.GetKind(), namespacedName(u), err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+//Prune deletes the live objects carrying ManagedByLabel=ManagedByValue (and,
+//when instance is non-empty, InstanceLabel=instance, matching the instance
+//NewManagedByEnhancer labeled them with) whose GroupKind, namespace and name
+//are not present in the set currently rendered from files, giving callers
+//clean-uninstall semantics across template changes (resources removed from
+//the template set entirely, renamed resources, etc). Scoping by instance keeps
+//two clusteradm-managed installs on the same cluster from pruning each
+//other's objects. It scans every listable GroupKind registered on the
+//cluster, not only the ones still rendered, since a resource dropped from the
+//templates no longer shows up in the rendered set at all; deletions happen in
+//the reverse of installOrder.
+func Prune(dynamicClient dynamic.Interface,
+	discoveryClient discovery.DiscoveryInterface,
+	reader asset.ScenarioReader,
+	values interface{},
+	headerFile string,
+	instance string,
+	files ...string) error {
+	var rendered []*unstructured.Unstructured
+	for _, name := range files {
+		objs, err := renderObjects(reader, values, headerFile, name)
+		if err != nil {
+			if IsEmptyAsset(err) {
+				continue
+			}
+			return err
+		}
+		rendered = append(rendered, objs...)
+	}
+
+	want := map[schema.GroupKind]map[string]bool{}
+	for _, u := range rendered {
+		gk := u.GroupVersionKind().GroupKind()
+		if want[gk] == nil {
+			want[gk] = map[string]bool{}
+		}
+		want[gk][namespacedName(u)] = true
+	}
+
+	registered, err := registeredGroupKinds(discoveryClient)
+	if err != nil {
+		return err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+
+	candidates := make([]schema.GroupKind, 0, len(registered))
+	for gk, verbs := range registered {
+		//Create-only/virtual resources (TokenReview, SubjectAccessReview,
+		//Binding, ...) register without a "list" verb; listing them 405s.
+		if !verbs.Has("list") {
+			continue
+		}
+		candidates = append(candidates, gk)
+	}
+	sortGroupKindsByInstallOrder(candidates)
+
+	selector := ManagedByLabel + "=" + ManagedByValue
+	if instance != "" {
+		selector += "," + InstanceLabel + "=" + instance
+	}
+
+	var errs []error
+	for i := len(candidates) - 1; i >= 0; i-- {
+		gk := candidates[i]
+		mapping, err := mapper.RESTMapping(gk)
+		if err != nil {
+			//Not every registered GroupKind is listable through the dynamic
+			//client (for example pure subresources); skip those quietly.
+			continue
+		}
+		live, err := dynamicClient.Resource(mapping.Resource).Namespace(metav1.NamespaceAll).
+			List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			if apierrors.IsMethodNotSupported(err) {
+				//Discovery's verb list can be stale; tolerate a 405 the same
+				//way the "list" verb filter above is meant to avoid.
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%s: %v", gk, err))
+			continue
+		}
+		for j := range live.Items {
+			obj := live.Items[j]
+			if want[gk][namespacedName(&obj)] {
+				continue
+			}
+			if err := deleteUnstructured(dynamicClient, mapper, &obj); err != nil {
+				errs = append(errs, fmt.Errorf("%s %s: %v", obj.GetKind(), namespacedName(&obj), err))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+//namespacedName returns "namespace/name", or just "name" for cluster-scoped
+//objects.
+func namespacedName(u *unstructured.Unstructured) string {
+	if u.GetNamespace() == "" {
+		return u.GetName()
+	}
+	return u.GetNamespace() + "/" + u.GetName()
+}
+
+//registeredGroupKinds returns, for every GroupKind currently served by the
+//cluster's discovery API, the set of discovery verbs it supports (so callers
+//can tell a listable resource from a create-only/virtual one like TokenReview
+//or Binding). Partial discovery failures (for example a single broken
+//APIService) are tolerated as long as some resource lists came back,
+//mirroring how other callers of ServerGroupsAndResources cope with a
+//partially available API surface.
+func registeredGroupKinds(discoveryClient discovery.DiscoveryInterface) (map[schema.GroupKind]sets.String, error) {
+	_, apiResourceLists, err := discoveryClient.ServerGroupsAndResources()
+	if err != nil && apiResourceLists == nil {
+		return nil, err
+	}
+	registered := map[schema.GroupKind]sets.String{}
+	for _, list := range apiResourceLists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, r := range list.APIResources {
+			gk := schema.GroupKind{Group: gv.Group, Kind: r.Kind}
+			if registered[gk] == nil {
+				registered[gk] = sets.NewString()
+			}
+			registered[gk].Insert(r.Verbs...)
+		}
+	}
+	return registered, nil
+}
@@ -0,0 +1,126 @@
+// Copyright Contributors to the Open Cluster Management project
+package apply
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	//ManagedByLabel marks every object applied by this package so it can later be
+	//identified for pruning or a clean uninstall.
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	//ManagedByValue is the value NewManagedByEnhancer sets for ManagedByLabel.
+	ManagedByValue = "clusteradm"
+	//InstanceLabel distinguishes objects from one install from another, so that
+	//Prune does not treat a different install's managed objects as orphans.
+	InstanceLabel = "app.kubernetes.io/instance"
+)
+
+//Enhancer decorates a rendered object before it is applied, for example to
+//inject common labels, annotations or an owner reference.
+type Enhancer interface {
+	Enhance(u *unstructured.Unstructured) error
+}
+
+//EnhancerFunc adapts a function to the Enhancer interface.
+type EnhancerFunc func(u *unstructured.Unstructured) error
+
+//Enhance calls f.
+func (f EnhancerFunc) Enhance(u *unstructured.Unstructured) error {
+	return f(u)
+}
+
+//NewManagedByEnhancer returns an Enhancer that labels every object with
+//ManagedByLabel=ManagedByValue, plus the given instance label value (when
+//instance is non-empty) so that objects from one install can be distinguished
+//from another.
+func NewManagedByEnhancer(instance string) Enhancer {
+	return EnhancerFunc(func(u *unstructured.Unstructured) error {
+		labels := u.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[ManagedByLabel] = ManagedByValue
+		if instance != "" {
+			labels[InstanceLabel] = instance
+		}
+		u.SetLabels(labels)
+		return nil
+	})
+}
+
+//NewAnnotationsEnhancer returns an Enhancer that merges annotations into every
+//object, without overwriting annotations the template already set.
+func NewAnnotationsEnhancer(annotations map[string]string) Enhancer {
+	return EnhancerFunc(func(u *unstructured.Unstructured) error {
+		existing := u.GetAnnotations()
+		if existing == nil {
+			existing = map[string]string{}
+		}
+		for k, v := range annotations {
+			if _, ok := existing[k]; !ok {
+				existing[k] = v
+			}
+		}
+		u.SetAnnotations(existing)
+		return nil
+	})
+}
+
+//NewOwnerReferenceEnhancer returns an Enhancer that adds owner to every
+//object's owner references, replacing any existing reference with the same
+//UID (or, lacking a UID, the same APIVersion/Kind/Name) so re-applying does
+//not accumulate duplicates.
+func NewOwnerReferenceEnhancer(owner metav1.OwnerReference) Enhancer {
+	return EnhancerFunc(func(u *unstructured.Unstructured) error {
+		refs := u.GetOwnerReferences()
+		kept := make([]metav1.OwnerReference, 0, len(refs)+1)
+		for _, ref := range refs {
+			if sameOwner(ref, owner) {
+				continue
+			}
+			kept = append(kept, ref)
+		}
+		u.SetOwnerReferences(append(kept, owner))
+		return nil
+	})
+}
+
+//sameOwner reports whether a and b identify the same owner, preferring UID
+//when both have one and falling back to APIVersion/Kind/Name otherwise.
+func sameOwner(a, b metav1.OwnerReference) bool {
+	if a.UID != "" && b.UID != "" {
+		return a.UID == b.UID
+	}
+	return a.APIVersion == b.APIVersion && a.Kind == b.Kind && a.Name == b.Name
+}
+
+//enhance runs every enhancer over u, in order, stopping at the first error.
+func enhance(u *unstructured.Unstructured, enhancers []Enhancer) error {
+	for _, e := range enhancers {
+		if err := e.Enhance(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//enhanceTyped runs enhancers over a typed object by round-tripping it through
+//its unstructured representation, for apply paths that only have a typed
+//client available (e.g. ApplyDeployment).
+func enhanceTyped(obj runtime.Object, enhancers []Enhancer) error {
+	if len(enhancers) == 0 {
+		return nil
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	if err := enhance(u, enhancers); err != nil {
+		return err
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, obj)
+}
@@ -0,0 +1,43 @@
+// Copyright Contributors to the Open Cluster Management project
+package apply
+
+//Mode selects the reconciliation strategy used to apply a rendered object.
+type Mode int
+
+const (
+	//ModeClientSide performs a get-then-create/update against the cluster. This
+	//is the default and the behavior this package has always had.
+	ModeClientSide Mode = iota
+	//ModeServerSideApply issues a server-side apply PATCH (types.ApplyPatchType),
+	//letting the API server resolve field ownership instead of doing a
+	//client-side read-modify-write. This removes the read-modify-write race
+	//ModeClientSide has, and gives proper field ownership when multiple
+	//controllers touch the same object (common with OCM addons).
+	ModeServerSideApply
+)
+
+//DefaultFieldManager is the field manager used to identify fields owned by
+//this package when applying with ModeServerSideApply.
+const DefaultFieldManager = "clusteradm"
+
+//Options controls how ApplyCustomResouces and the Applier reconcile rendered
+//objects with the cluster.
+type Options struct {
+	//Enhancers run over every rendered object, in order, before it is applied.
+	Enhancers []Enhancer
+	//Mode selects the reconciliation strategy. The zero value is ModeClientSide.
+	Mode Mode
+	//FieldManager identifies the owner of fields set through
+	//ModeServerSideApply. Defaults to DefaultFieldManager when empty.
+	FieldManager string
+	//Force steers field-ownership conflict resolution in ModeServerSideApply;
+	//it has no effect in ModeClientSide.
+	Force bool
+}
+
+func (o Options) fieldManager() string {
+	if o.FieldManager == "" {
+		return DefaultFieldManager
+	}
+	return o.FieldManager
+}